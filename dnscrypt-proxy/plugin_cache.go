@@ -0,0 +1,282 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// CacheKey identifies a cacheable query. Responses are segregated by
+// lowercased name, type, class, whether DNSSEC data was requested, and an
+// ECS-derived subnet (if any): initially the subnet sent upstream via
+// EDNS Client Subnet, narrowed by PluginECSResponse to the server's
+// returned SCOPE PREFIX-LENGTH before the entry is stored, so a CDN that
+// answers differently per subnet doesn't collide entries across clients.
+type CacheKey struct {
+	qName     string
+	qType     uint16
+	qClass    uint16
+	dnssecOK  bool
+	ecsSubnet string
+}
+
+// cacheKeyFromMsg derives a CacheKey from msg. dnssecOKOverride, when
+// non-nil, takes precedence over the message's own DO bit: PluginDNSSECQuery
+// forces DO=1 on every outgoing query once validation is enabled, so by the
+// time a response reaches the cache the message's DO bit no longer reflects
+// what the client actually asked for, and the cache key must not conflate a
+// DO=0 client with a DO=1 one.
+func cacheKeyFromMsg(msg *dns.Msg, dnssecOKOverride *bool) (CacheKey, bool) {
+	if len(msg.Question) != 1 {
+		return CacheKey{}, false
+	}
+	q := msg.Question[0]
+	dnssecOK := false
+	ecsSubnet := ""
+	if opt := msg.IsEdns0(); opt != nil {
+		dnssecOK = opt.Do()
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				ecsSubnet = fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+			}
+		}
+	}
+	if dnssecOKOverride != nil {
+		dnssecOK = *dnssecOKOverride
+	}
+	return CacheKey{
+		qName:     strings.ToLower(q.Name),
+		qType:     q.Qtype,
+		qClass:    q.Qclass,
+		dnssecOK:  dnssecOK,
+		ecsSubnet: ecsSubnet,
+	}, true
+}
+
+type cacheEntry struct {
+	key        CacheKey
+	msg        *dns.Msg
+	expiration time.Time
+	hitCount   uint64
+}
+
+// PluginCache is an LRU response cache, bounded by maxSize entries and
+// shared by PluginCacheQuery (serves hits, triggers prefetch) and
+// PluginCacheResponse (populates it on miss).
+type PluginCache struct {
+	sync.Mutex
+	maxSize int
+	minTTL  uint32
+	maxTTL  uint32
+	negTTL  uint32
+
+	prefetch        bool
+	prefetchBefore  time.Duration
+	prefetchMinHits uint64
+
+	list  *list.List
+	items map[CacheKey]*list.Element
+}
+
+func NewPluginCache(proxy *Proxy) *PluginCache {
+	return &PluginCache{
+		maxSize:         proxy.cacheSize,
+		minTTL:          proxy.cacheMinTTL,
+		maxTTL:          proxy.cacheMaxTTL,
+		negTTL:          proxy.cacheNegTTL,
+		prefetch:        proxy.cachePrefetch,
+		prefetchBefore:  time.Duration(proxy.cachePrefetchSeconds) * time.Second,
+		prefetchMinHits: proxy.cachePrefetchMinHits,
+		list:            list.New(),
+		items:           make(map[CacheKey]*list.Element),
+	}
+}
+
+func (cache *PluginCache) get(key CacheKey) (*cacheEntry, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	elem, ok := cache.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expiration) {
+		cache.list.Remove(elem)
+		delete(cache.items, key)
+		return nil, false
+	}
+	entry.hitCount++
+	cache.list.MoveToFront(elem)
+	return entry, true
+}
+
+func (cache *PluginCache) set(key CacheKey, msg *dns.Msg, ttl uint32) {
+	cache.Lock()
+	defer cache.Unlock()
+	entry := &cacheEntry{key: key, msg: msg, expiration: time.Now().Add(time.Duration(ttl) * time.Second)}
+	if elem, ok := cache.items[key]; ok {
+		elem.Value = entry
+		cache.list.MoveToFront(elem)
+		return
+	}
+	elem := cache.list.PushFront(entry)
+	cache.items[key] = elem
+	for cache.maxSize > 0 && cache.list.Len() > cache.maxSize {
+		oldest := cache.list.Back()
+		if oldest == nil {
+			break
+		}
+		cache.list.Remove(oldest)
+		delete(cache.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func clampTTL(ttl uint32, minTTL uint32, maxTTL uint32) uint32 {
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	return ttl
+}
+
+// answerTTL returns the effective TTL for a response: the lowest TTL
+// across its answer RRset for a positive response, or negTTL for
+// NXDOMAIN/NODATA, per RFC 2308.
+func answerTTL(msg *dns.Msg, negTTL uint32) uint32 {
+	if msg.Rcode == dns.RcodeNameError {
+		return negTTL
+	}
+	ttl, found := uint32(0), false
+	for _, rr := range msg.Answer {
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+	if !found {
+		return negTTL
+	}
+	return ttl
+}
+
+// rewriteTTLs sets every RR's TTL to the number of seconds actually
+// remaining before the cache entry expires, so a client never sees a
+// cached response claim to be fresher than it is. The OPT pseudo-RR is
+// skipped: its Hdr.Ttl field doesn't hold a TTL at all, but the packed
+// extended RCODE/version/flags (RFC 6891), so overwriting it would
+// corrupt EDNS0 on every synthesized response.
+func rewriteTTLs(msg *dns.Msg, remaining uint32) {
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = remaining
+		}
+	}
+}
+
+// PluginCacheQuery is the query-side half of the response cache: it
+// serves a synthetic response on a hit and arranges for a background
+// prefetch when the entry is hot and close to expiring.
+type PluginCacheQuery struct {
+	cache *PluginCache
+}
+
+func (plugin *PluginCacheQuery) Name() string { return "cache_query" }
+func (plugin *PluginCacheQuery) Description() string {
+	return "In-memory LRU response cache (query side)"
+}
+
+func (plugin *PluginCacheQuery) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	key, ok := cacheKeyFromMsg(msg, pluginsState.dnssecClientDO)
+	if !ok {
+		return nil
+	}
+	pluginsState.cacheKey = key
+	pluginsState.cacheKeySet = true
+	entry, hit := plugin.cache.get(key)
+	if !hit {
+		return nil
+	}
+	remaining := uint32(time.Until(entry.expiration).Seconds())
+	synth := entry.msg.Copy()
+	synth.Id = msg.Id
+	rewriteTTLs(synth, remaining)
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+
+	if plugin.cache.prefetch && entry.hitCount >= plugin.cache.prefetchMinHits &&
+		time.Until(entry.expiration) < plugin.cache.prefetchBefore {
+		go pluginsState.proxy.prefetchCacheEntry(plugin.cache, key, msg)
+	}
+	return nil
+}
+
+// PluginCacheResponse is the response-side half: it stores a fresh
+// upstream answer into the shared cache.
+type PluginCacheResponse struct {
+	cache *PluginCache
+}
+
+func (plugin *PluginCacheResponse) Name() string { return "cache_response" }
+func (plugin *PluginCacheResponse) Description() string {
+	return "In-memory LRU response cache (response side)"
+}
+
+func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if !pluginsState.cacheKeySet {
+		return nil
+	}
+	ttl := clampTTL(answerTTL(msg, plugin.cache.negTTL), plugin.cache.minTTL, plugin.cache.maxTTL)
+	plugin.cache.set(pluginsState.cacheKey, msg.Copy(), ttl)
+	return nil
+}
+
+// prefetchCacheEntry re-resolves a hot, soon-to-expire cache entry in the
+// background so that it never actually misses from the client's point of
+// view. The response is run through the normal response plugin chain
+// (DNSSEC validation, ECS stripping, cache storage) rather than stored
+// directly, so a prefetch can't end up caching an entry none of those
+// plugins would otherwise have let through.
+func (proxy *Proxy) prefetchCacheEntry(cache *PluginCache, key CacheKey, questionMsg *dns.Msg) {
+	query := questionMsg.Copy()
+	query.Id = dns.Id()
+	packed, err := query.Pack()
+	if err != nil {
+		return
+	}
+	serverInfo := proxy.serversInfo.getOne()
+	if serverInfo == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proxy.timeout)
+	defer cancel()
+	serverInfo.noticeBegin(proxy)
+	response, err := proxy.exchangeWithServer(ctx, serverInfo, packed, proxy.mainProto)
+	if err != nil {
+		serverInfo.noticeFailure(proxy)
+		dlog.Debugf("Prefetch for [%s] failed: %v", key.qName, err)
+		return
+	}
+	serverInfo.noticeSuccess(proxy)
+
+	pluginsState := NewPluginsState(proxy, "prefetch", nil)
+	pluginsState.cacheKey = key
+	pluginsState.cacheKeySet = true
+	dnssecOK := key.dnssecOK
+	pluginsState.dnssecClientDO = &dnssecOK
+	if _, err := pluginsState.ApplyResponsePlugins(&proxy.pluginsGlobals, response); err != nil {
+		dlog.Debugf("Prefetch for [%s] failed: %v", key.qName, err)
+		return
+	}
+	dlog.Debugf("Prefetched [%s]", key.qName)
+}
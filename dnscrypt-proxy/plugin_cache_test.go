@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClampTTL(t *testing.T) {
+	cases := []struct {
+		name          string
+		ttl, min, max uint32
+		want          uint32
+	}{
+		{"within bounds", 300, 60, 3600, 300},
+		{"below min", 10, 60, 3600, 60},
+		{"above max", 7200, 60, 3600, 3600},
+		{"max disabled", 1000000, 60, 0, 1000000},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := clampTTL(c.ttl, c.min, c.max); got != c.want {
+				t.Fatalf("clampTTL(%d, %d, %d) = %d, want %d", c.ttl, c.min, c.max, got, c.want)
+			}
+		})
+	}
+}
+
+func TestAnswerTTLUsesLowestAnswerTTL(t *testing.T) {
+	msg := &dns.Msg{}
+	msg.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Ttl: 300}},
+		&dns.A{Hdr: dns.RR_Header{Ttl: 60}},
+		&dns.A{Hdr: dns.RR_Header{Ttl: 600}},
+	}
+	if got := answerTTL(msg, 120); got != 60 {
+		t.Fatalf("expected 60, got %d", got)
+	}
+}
+
+func TestAnswerTTLFallsBackToNegTTLForNXDOMAIN(t *testing.T) {
+	msg := &dns.Msg{}
+	msg.Rcode = dns.RcodeNameError
+	msg.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 300}}}
+	if got := answerTTL(msg, 120); got != 120 {
+		t.Fatalf("expected negTTL 120 for NXDOMAIN, got %d", got)
+	}
+}
+
+func TestAnswerTTLFallsBackToNegTTLForEmptyAnswer(t *testing.T) {
+	msg := &dns.Msg{}
+	if got := answerTTL(msg, 120); got != 120 {
+		t.Fatalf("expected negTTL 120 for NODATA, got %d", got)
+	}
+}
+
+func TestRewriteTTLsSkipsOPT(t *testing.T) {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Ttl: 0x00008000}}
+	msg := &dns.Msg{}
+	msg.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 300}}}
+	msg.Extra = []dns.RR{opt}
+
+	rewriteTTLs(msg, 42)
+
+	if msg.Answer[0].Header().Ttl != 42 {
+		t.Fatalf("expected answer TTL rewritten to 42, got %d", msg.Answer[0].Header().Ttl)
+	}
+	if opt.Hdr.Ttl != 0x00008000 {
+		t.Fatalf("expected OPT's packed flags left untouched, got %#x", opt.Hdr.Ttl)
+	}
+}
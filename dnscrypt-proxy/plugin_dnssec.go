@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// validatedZone is a cache entry recording the DNSKEY RRset that has
+// already been proven to chain to the trust anchor for a given zone, so
+// repeated queries under the same zone don't re-chase the chain.
+type validatedZone struct {
+	keys       []*dns.DNSKEY
+	expiration time.Time
+}
+
+// DNSSECValidator walks the chain of trust from a configured root trust
+// anchor down to the zone answering a query, verifying DS/DNSKEY
+// signatures at every delegation point, with the validated DNSKEY sets
+// cached with respect to their RRSIGs' expiration.
+type DNSSECValidator struct {
+	sync.Mutex
+	cache       map[string]*validatedZone
+	trustAnchor *dns.DS
+}
+
+// NewDNSSECValidator parses trustAnchorStr -- a DS record in zone-file
+// presentation format, e.g. the root KSK-2017/2024 DS -- and returns a
+// validator anchored to it.
+func NewDNSSECValidator(trustAnchorStr string) (*DNSSECValidator, error) {
+	rr, err := dns.NewRR(trustAnchorStr)
+	if err != nil {
+		return nil, err
+	}
+	ds, ok := rr.(*dns.DS)
+	if !ok {
+		return nil, errors.New("DNSSEC trust anchor is not a DS record")
+	}
+	return &DNSSECValidator{cache: make(map[string]*validatedZone), trustAnchor: ds}, nil
+}
+
+func parentZone(zone string) string {
+	labels := dns.SplitDomainName(zone)
+	if len(labels) <= 1 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[1:], "."))
+}
+
+func splitRRsetAndSigs(rrs []dns.RR, rrType uint16) ([]dns.RR, []*dns.RRSIG) {
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrType {
+			sigs = append(sigs, sig)
+		} else if rr.Header().Rrtype == rrType {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset, sigs
+}
+
+// verifyRRSIGWithKeys reports whether any unexpired signature in sigs
+// verifies rrset against one of keys.
+func verifyRRSIGWithKeys(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) bool {
+	if len(rrset) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag {
+				continue
+			}
+			if sig.Verify(key, rrset) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func minRRSIGExpiration(sigs []*dns.RRSIG) time.Time {
+	var min time.Time
+	for _, sig := range sigs {
+		exp := time.Unix(int64(sig.Expiration), 0)
+		if min.IsZero() || exp.Before(min) {
+			min = exp
+		}
+	}
+	return min
+}
+
+// resolveSigned sends a DO=1 query for (name, qtype) to serverInfo and
+// returns the unpacked response, so DNSKEY/DS records come back with
+// their RRSIGs attached.
+func (proxy *Proxy) resolveSigned(ctx context.Context, serverInfo *ServerInfo, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+	msg.Id = dns.Id()
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	response, err := proxy.exchangeWithServer(ctx, serverInfo, packed, proxy.mainProto)
+	if err != nil {
+		return nil, err
+	}
+	respMsg := new(dns.Msg)
+	if err := respMsg.Unpack(response); err != nil {
+		return nil, err
+	}
+	return respMsg, nil
+}
+
+// chainedKeys returns the DNSKEY RRset for zone, proven to chain to the
+// trust anchor, fetching and verifying DS and DNSKEY RRsets along the
+// way (recursively, down from the root) and caching the result.
+func (validator *DNSSECValidator) chainedKeys(ctx context.Context, proxy *Proxy, serverInfo *ServerInfo, zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.Fqdn(zone)
+	validator.Lock()
+	if cached, ok := validator.cache[zone]; ok && time.Now().Before(cached.expiration) {
+		validator.Unlock()
+		return cached.keys, nil
+	}
+	validator.Unlock()
+
+	dnskeyMsg, err := proxy.resolveSigned(ctx, serverInfo, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	dnskeyRRset, dnskeySigs := splitRRsetAndSigs(dnskeyMsg.Answer, dns.TypeDNSKEY)
+	if len(dnskeyRRset) == 0 {
+		return nil, errors.New("no DNSKEY records for " + zone)
+	}
+	keys := make([]*dns.DNSKEY, 0, len(dnskeyRRset))
+	for _, rr := range dnskeyRRset {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	var ds *dns.DS
+	if zone == "." {
+		ds = validator.trustAnchor
+	} else {
+		parentKeys, err := validator.chainedKeys(ctx, proxy, serverInfo, parentZone(zone))
+		if err != nil {
+			return nil, err
+		}
+		dsMsg, err := proxy.resolveSigned(ctx, serverInfo, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		dsRRset, dsSigs := splitRRsetAndSigs(dsMsg.Answer, dns.TypeDS)
+		if !verifyRRSIGWithKeys(dsRRset, dsSigs, parentKeys) {
+			return nil, errors.New("DS RRset failed signature verification for " + zone)
+		}
+		for _, rr := range dsRRset {
+			if candidate, ok := rr.(*dns.DS); ok {
+				ds = candidate
+				break
+			}
+		}
+	}
+	if ds == nil {
+		return nil, errors.New("no DS available for " + zone)
+	}
+
+	var ksk *dns.DNSKEY
+	for _, key := range keys {
+		if strings.EqualFold(key.ToDS(ds.DigestType).Digest, ds.Digest) {
+			ksk = key
+			break
+		}
+	}
+	if ksk == nil {
+		return nil, errors.New("no DNSKEY matches the DS record for " + zone)
+	}
+	if !verifyRRSIGWithKeys(dnskeyRRset, dnskeySigs, []*dns.DNSKEY{ksk}) {
+		return nil, errors.New("DNSKEY RRset failed self-signature verification for " + zone)
+	}
+
+	expiration := time.Now().Add(time.Hour)
+	if minExp := minRRSIGExpiration(dnskeySigs); !minExp.IsZero() && minExp.Before(expiration) {
+		expiration = minExp
+	}
+	validator.Lock()
+	validator.cache[zone] = &validatedZone{keys: keys, expiration: expiration}
+	validator.Unlock()
+	return keys, nil
+}
+
+// hasValidDenialProof reports whether msg carries an NSEC or NSEC3
+// RRset with a signature that verifies against keys. It authenticates
+// the denial-of-existence records but does not independently re-derive
+// name coverage from them.
+func hasValidDenialProof(msg *dns.Msg, keys []*dns.DNSKEY) bool {
+	nsecRRset, nsecSigs := splitRRsetAndSigs(msg.Ns, dns.TypeNSEC)
+	if verifyRRSIGWithKeys(nsecRRset, nsecSigs, keys) {
+		return true
+	}
+	nsec3RRset, nsec3Sigs := splitRRsetAndSigs(msg.Ns, dns.TypeNSEC3)
+	return verifyRRSIGWithKeys(nsec3RRset, nsec3Sigs, keys)
+}
+
+// PluginDNSSECQuery sets DO=1 on outgoing queries when DNSSEC validation
+// is enabled, so upstream servers return RRSIGs to validate against.
+type PluginDNSSECQuery struct{}
+
+func (plugin *PluginDNSSECQuery) Name() string        { return "dnssec_query" }
+func (plugin *PluginDNSSECQuery) Description() string { return "Request DNSSEC records for validation" }
+
+func (plugin *PluginDNSSECQuery) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	opt := msg.IsEdns0()
+	originalDO := opt != nil && opt.Do()
+	pluginsState.dnssecClientDO = &originalDO
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+		return nil
+	}
+	opt.SetDo(true)
+	return nil
+}
+
+// PluginDNSSECResponse validates a response against the configured trust
+// anchor and returns SERVFAIL with AD=0 in place of bogus data, rather
+// than passing it on to the client or the cache.
+type PluginDNSSECResponse struct{}
+
+func (plugin *PluginDNSSECResponse) Name() string        { return "dnssec_response" }
+func (plugin *PluginDNSSECResponse) Description() string { return "DNSSEC response validation" }
+
+func (plugin *PluginDNSSECResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	proxy := pluginsState.proxy
+	if proxy.dnssecValidator == nil || len(msg.Question) != 1 {
+		return nil
+	}
+
+	// PluginDNSSECQuery forced DO=1 on the outgoing query so this plugin
+	// could validate; a client that never asked for DNSSEC records must
+	// not see them, or the forced DO bit, regardless of which path below
+	// returns.
+	clientRequestedDO := pluginsState.dnssecClientDO != nil && *pluginsState.dnssecClientDO
+	if !clientRequestedDO {
+		defer func() {
+			stripDNSSECRecords(msg)
+			if opt := msg.IsEdns0(); opt != nil {
+				opt.SetDo(false)
+			}
+		}()
+	}
+
+	q := msg.Question[0]
+
+	serverInfo := proxy.serversInfo.byName(proxy.dnssecValidatingServer)
+	if serverInfo == nil {
+		serverInfo = proxy.serversInfo.getOne()
+	}
+	if serverInfo == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), proxy.timeout)
+	defer cancel()
+
+	rrset, sigs := splitRRsetAndSigs(msg.Answer, q.Qtype)
+	zone := signerZone(sigs, msg.Ns, q.Name)
+
+	keys, err := proxy.dnssecValidator.chainedKeys(ctx, proxy, serverInfo, zone)
+	secure := false
+	if err == nil {
+		if len(rrset) > 0 {
+			secure = verifyRRSIGWithKeys(rrset, sigs, keys)
+		} else {
+			secure = hasValidDenialProof(msg, keys)
+		}
+	} else {
+		dlog.Debugf("DNSSEC chain of trust could not be established for [%s]: %v", zone, err)
+	}
+
+	opt := msg.IsEdns0()
+	if !secure {
+		dlog.Infof("DNSSEC validation failed for [%s]", q.Name)
+		msg.Rcode = dns.RcodeServerFailure
+		msg.Answer = nil
+		msg.Ns = nil
+		msg.Extra = nil
+		msg.AuthenticatedData = false
+		if opt != nil {
+			opt.SetDo(false)
+		}
+		return nil
+	}
+	msg.AuthenticatedData = true
+	return nil
+}
+
+// stripDNSSECRecords removes DNSSEC-specific RRs (RRSIG, NSEC, NSEC3,
+// DNSKEY, DS) from a response, for clients that never set the DO bit on
+// their query: the proxy needs them on the wire to validate, but a
+// non-validating stub resolver never asked for them and RFC 4035 section
+// 3.2.1 leaves it up to the responder not to send them unprompted.
+func stripDNSSECRecords(msg *dns.Msg) {
+	msg.Answer = stripDNSSECRRs(msg.Answer)
+	msg.Ns = stripDNSSECRRs(msg.Ns)
+	msg.Extra = stripDNSSECRRs(msg.Extra)
+}
+
+func stripDNSSECRRs(rrs []dns.RR) []dns.RR {
+	filtered := rrs[:0]
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDNSKEY, dns.TypeDS:
+			continue
+		}
+		filtered = append(filtered, rr)
+	}
+	return filtered
+}
+
+// signerZone returns the zone that signed the answered RRset: the
+// SignerName of its covering RRSIG, which is the DNSKEY owner to chase,
+// as opposed to the (possibly far below the apex) query name itself. It
+// falls back to the RRSIG covering an NSEC/NSEC3 denial-of-existence
+// proof, and finally to qName if no signature is present at all (an
+// unsigned or bogus response, which chainedKeys/verification will then
+// reject).
+func signerZone(answerSigs []*dns.RRSIG, ns []dns.RR, qName string) string {
+	if len(answerSigs) > 0 {
+		return answerSigs[0].SignerName
+	}
+	if _, sigs := splitRRsetAndSigs(ns, dns.TypeNSEC); len(sigs) > 0 {
+		return sigs[0].SignerName
+	}
+	if _, sigs := splitRRsetAndSigs(ns, dns.TypeNSEC3); len(sigs) > 0 {
+		return sigs[0].SignerName
+	}
+	return qName
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// signedRRset generates an ECDSAP256SHA256 zone key, signs rrset with it,
+// and returns the key alongside the RRSIG covering it.
+func signedRRset(t *testing.T, signerName string, rrset []dns.RR) (*dns.DNSKEY, *dns.RRSIG) {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: signerName, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: signerName, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		TypeCovered: rrset[0].Header().Rrtype,
+		Algorithm:   dns.ECDSAP256SHA256,
+		Labels:      uint8(dns.CountLabel(signerName)),
+		OrigTtl:     3600,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      key.KeyTag(),
+		SignerName:  signerName,
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		t.Fatalf("generated key does not implement crypto.Signer: %T", priv)
+	}
+	if err := sig.Sign(signer, rrset); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return key, sig
+}
+
+func TestVerifyRRSIGWithKeysValidSignature(t *testing.T) {
+	a := &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}}
+	rrset := []dns.RR{a}
+	key, sig := signedRRset(t, "example.com.", rrset)
+
+	if !verifyRRSIGWithKeys(rrset, []*dns.RRSIG{sig}, []*dns.DNSKEY{key}) {
+		t.Fatal("expected a validly signed RRset to verify")
+	}
+}
+
+func TestVerifyRRSIGWithKeysWrongKey(t *testing.T) {
+	a := &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}}
+	rrset := []dns.RR{a}
+	_, sig := signedRRset(t, "example.com.", rrset)
+
+	otherKey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	if _, err := otherKey.Generate(256); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	if verifyRRSIGWithKeys(rrset, []*dns.RRSIG{sig}, []*dns.DNSKEY{otherKey}) {
+		t.Fatal("expected verification to fail against an unrelated key")
+	}
+}
+
+func TestVerifyRRSIGWithKeysExpiredSignature(t *testing.T) {
+	a := &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}}
+	rrset := []dns.RR{a}
+	key, sig := signedRRset(t, "example.com.", rrset)
+	sig.Expiration = uint32(time.Now().Add(-time.Hour).Unix())
+	sig.Inception = uint32(time.Now().Add(-2 * time.Hour).Unix())
+
+	if verifyRRSIGWithKeys(rrset, []*dns.RRSIG{sig}, []*dns.DNSKEY{key}) {
+		t.Fatal("expected an expired signature to be rejected")
+	}
+}
+
+func TestDNSKEYMatchesDSDigest(t *testing.T) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	if _, err := key.Generate(256); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	ds := key.ToDS(dns.SHA256)
+	if ds == nil {
+		t.Fatal("expected ToDS to produce a DS record")
+	}
+	if !(key.ToDS(ds.DigestType).Digest == ds.Digest) {
+		t.Fatal("expected the key's own DS digest to match itself")
+	}
+
+	other := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	if _, err := other.Generate(256); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if other.ToDS(ds.DigestType).Digest == ds.Digest {
+		t.Fatal("expected a different key to produce a different DS digest")
+	}
+}
+
+func TestSignerZonePrefersRRSIGSignerName(t *testing.T) {
+	sig := &dns.RRSIG{SignerName: "example.com."}
+	got := signerZone([]*dns.RRSIG{sig}, nil, "www.example.com.")
+	if got != "example.com." {
+		t.Fatalf("expected example.com., got %s", got)
+	}
+}
+
+func TestSignerZoneFallsBackToDenialProof(t *testing.T) {
+	nsecSig := &dns.RRSIG{Hdr: dns.RR_Header{Rrtype: dns.TypeRRSIG}, TypeCovered: dns.TypeNSEC, SignerName: "example.com."}
+	ns := []dns.RR{nsecSig}
+	got := signerZone(nil, ns, "missing.example.com.")
+	if got != "example.com." {
+		t.Fatalf("expected example.com. from the NSEC RRSIG, got %s", got)
+	}
+}
+
+func TestSignerZoneFallsBackToQName(t *testing.T) {
+	got := signerZone(nil, nil, "unsigned.example.com.")
+	if got != "unsigned.example.com." {
+		t.Fatalf("expected the query name as a last resort, got %s", got)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ECSPolicy controls what, if anything, the proxy tells upstream servers
+// about the client's network via EDNS Client Subnet (RFC 7871).
+type ECSPolicy int
+
+const (
+	// ECSPolicyStrip removes any client-supplied ECS option and sends
+	// nothing upstream. This is the default, for privacy.
+	ECSPolicyStrip ECSPolicy = iota
+	// ECSPolicyForward sends the real client subnet, truncated to
+	// ecsIPv4PrefixLen/ecsIPv6PrefixLen, when every server the query may
+	// go to opts in via ServerInformalPropertyECS; otherwise nothing.
+	ECSPolicyForward
+	// ECSPolicyInject sends a fixed, operator-configured subnet,
+	// typically to steer a CDN towards a specific region.
+	ECSPolicyInject
+)
+
+func ECSPolicyFromString(str string) ECSPolicy {
+	switch str {
+	case "forward":
+		return ECSPolicyForward
+	case "inject":
+		return ECSPolicyInject
+	default:
+		return ECSPolicyStrip
+	}
+}
+
+const (
+	ecsIPv4PrefixLen = 24
+	ecsIPv6PrefixLen = 56
+)
+
+// PluginECSQuery enforces the proxy's EDNS Client Subnet policy on
+// outgoing queries. It always strips whatever the client supplied first,
+// since a spoofed or forwarded value from further upstream cannot be
+// trusted, then optionally substitutes the real (truncated) client
+// subnet or a fixed synthetic one.
+type PluginECSQuery struct{}
+
+func (plugin *PluginECSQuery) Name() string { return "ecs_query" }
+func (plugin *PluginECSQuery) Description() string {
+	return "EDNS Client Subnet scrubbing/forwarding on the query path"
+}
+
+func (plugin *PluginECSQuery) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	stripECS(msg)
+	var subnet *net.IPNet
+	switch pluginsState.proxy.ecsPolicy {
+	case ECSPolicyForward:
+		// The real subnet is only ever sent to servers whose stamp opts
+		// in; every other server only sees ECS under ecs_policy "inject".
+		if !allServersOptIntoECS(pluginsState.serverCandidates) {
+			return nil
+		}
+		subnet = truncatedClientSubnet(pluginsState.clientAddr)
+	case ECSPolicyInject:
+		subnet = pluginsState.proxy.ecsFixedSubnet
+	default:
+		return nil
+	}
+	if subnet == nil {
+		return nil
+	}
+	addECSOption(msg, subnet)
+	return nil
+}
+
+// allServersOptIntoECS reports whether every server a query might be
+// forwarded to (more than one, under parallel-race) advertises
+// ServerInformalPropertyECS.
+func allServersOptIntoECS(candidates []*ServerInfo) bool {
+	if len(candidates) == 0 {
+		return false
+	}
+	for _, serverInfo := range candidates {
+		if !serverInfo.ECSForward {
+			return false
+		}
+	}
+	return true
+}
+
+// PluginECSResponse strips any EDNS Client Subnet option an upstream
+// server echoed back, before the response is cached or handed back to
+// the client: the client never asked to leak its subnet. Before
+// stripping, it narrows the in-flight cache key to the SCOPE
+// PREFIX-LENGTH the server actually answered for (RFC 7871 section
+// 11.1), so a narrowly-scoped answer (e.g. a CDN answering for a single
+// /32) is never served from cache to a client outside that scope.
+type PluginECSResponse struct{}
+
+func (plugin *PluginECSResponse) Name() string { return "ecs_response" }
+func (plugin *PluginECSResponse) Description() string {
+	return "EDNS Client Subnet stripping on the response path"
+}
+
+func (plugin *PluginECSResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.cacheKeySet {
+		if scopeSubnet := responseScopeSubnet(msg, pluginsState.clientAddr); scopeSubnet != "" {
+			pluginsState.cacheKey.ecsSubnet = scopeSubnet
+		}
+	}
+	stripECS(msg)
+	return nil
+}
+
+// responseScopeSubnet derives a cache-segregation key from the SCOPE
+// PREFIX-LENGTH an upstream server returned: the real client address,
+// truncated to that many bits. Using the true client address rather than
+// whatever (possibly wider) subnet the proxy actually forwarded means the
+// resulting key is never wider than the scope the server asserted, at
+// the cost of a narrower cache key missing more often than a full
+// scope-aware trie would.
+func responseScopeSubnet(msg *dns.Msg, clientAddr *net.Addr) string {
+	opt := msg.IsEdns0()
+	if opt == nil || clientAddr == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		ip := addrIP(*clientAddr)
+		if ip == nil {
+			return ""
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			mask := net.CIDRMask(int(subnet.SourceScope), 32)
+			return fmt.Sprintf("%s/%d", ip4.Mask(mask), subnet.SourceScope)
+		}
+		mask := net.CIDRMask(int(subnet.SourceScope), 128)
+		return fmt.Sprintf("%s/%d", ip.Mask(mask), subnet.SourceScope)
+	}
+	return ""
+}
+
+func stripECS(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	opt.Option = removeECSOptions(opt.Option)
+}
+
+func removeECSOptions(options []dns.EDNS0) []dns.EDNS0 {
+	filtered := options[:0]
+	for _, option := range options {
+		if option.Option() != dns.EDNS0SUBNET {
+			filtered = append(filtered, option)
+		}
+	}
+	return filtered
+}
+
+func addECSOption(msg *dns.Msg, subnet *net.IPNet) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		msg.Extra = append(msg.Extra, opt)
+	}
+	ones, _ := subnet.Mask.Size()
+	family := uint16(1)
+	ip := subnet.IP.To4()
+	if ip == nil {
+		family = 2
+		ip = subnet.IP.To16()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(ones),
+		Address:       ip,
+	})
+}
+
+// truncatedClientSubnet derives the network to advertise upstream from
+// the client's real address: /24 for IPv4, /56 for IPv6.
+func truncatedClientSubnet(clientAddr *net.Addr) *net.IPNet {
+	if clientAddr == nil {
+		return nil
+	}
+	ip := addrIP(*clientAddr)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(ecsIPv4PrefixLen, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(ecsIPv6PrefixLen, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTruncatedClientSubnetIPv4(t *testing.T) {
+	var addr net.Addr = &net.UDPAddr{IP: net.ParseIP("203.0.113.42")}
+	subnet := truncatedClientSubnet(&addr)
+	if subnet == nil {
+		t.Fatal("expected a subnet, got nil")
+	}
+	if subnet.String() != "203.0.113.0/24" {
+		t.Fatalf("expected 203.0.113.0/24, got %s", subnet.String())
+	}
+}
+
+func TestTruncatedClientSubnetIPv6(t *testing.T) {
+	var addr net.Addr = &net.UDPAddr{IP: net.ParseIP("2001:db8:abcd:1234::1")}
+	subnet := truncatedClientSubnet(&addr)
+	if subnet == nil {
+		t.Fatal("expected a subnet, got nil")
+	}
+	if subnet.String() != "2001:db8:abcd:1200::/56" {
+		t.Fatalf("expected 2001:db8:abcd:1200::/56, got %s", subnet.String())
+	}
+}
+
+func TestTruncatedClientSubnetNilAddr(t *testing.T) {
+	if got := truncatedClientSubnet(nil); got != nil {
+		t.Fatalf("expected nil for a nil client address, got %v", got)
+	}
+}
+
+func TestAddECSOptionThenStripECS(t *testing.T) {
+	msg := &dns.Msg{}
+	_, subnet, err := net.ParseCIDR("203.0.113.0/24")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+	addECSOption(msg, subnet)
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		t.Fatal("expected addECSOption to create an OPT record")
+	}
+	found := false
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0SUBNET {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected an EDNS0_SUBNET option after addECSOption")
+	}
+
+	stripECS(msg)
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0SUBNET {
+			t.Fatal("expected no EDNS0_SUBNET option after stripECS")
+		}
+	}
+}
+
+func TestResponseScopeSubnetNarrowsToServerScope(t *testing.T) {
+	var clientAddr net.Addr = &net.UDPAddr{IP: net.ParseIP("203.0.113.42")}
+	msg := &dns.Msg{}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		SourceScope:   32,
+		Address:       net.ParseIP("203.0.113.0"),
+	})
+	msg.Extra = append(msg.Extra, opt)
+
+	got := responseScopeSubnet(msg, &clientAddr)
+	want := "203.0.113.42/32"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestResponseScopeSubnetNoECSOption(t *testing.T) {
+	var clientAddr net.Addr = &net.UDPAddr{IP: net.ParseIP("203.0.113.42")}
+	msg := &dns.Msg{}
+	if got := responseScopeSubnet(msg, &clientAddr); got != "" {
+		t.Fatalf("expected empty string with no ECS option, got %s", got)
+	}
+}
+
+func TestAllServersOptIntoECS(t *testing.T) {
+	optedIn := &ServerInfo{Name: "a", ECSForward: true}
+	optedOut := &ServerInfo{Name: "b", ECSForward: false}
+
+	if !allServersOptIntoECS([]*ServerInfo{optedIn}) {
+		t.Fatal("expected true when every candidate opts in")
+	}
+	if allServersOptIntoECS([]*ServerInfo{optedIn, optedOut}) {
+		t.Fatal("expected false when any candidate doesn't opt in")
+	}
+	if allServersOptIntoECS(nil) {
+		t.Fatal("expected false with no candidates")
+	}
+}
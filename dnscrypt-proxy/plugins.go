@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// PluginsAction tells processIncomingQuery what to do with the query
+// after the query-side plugins have run.
+type PluginsAction int
+
+const (
+	PluginsActionForward PluginsAction = iota
+	PluginsActionDrop
+	PluginsActionSynth
+)
+
+// Plugin is implemented by every query-side and response-side plugin.
+// Eval mutates pluginsState (e.g. to set an action or a synthetic
+// response) based on msg, the unpacked query or response.
+type Plugin interface {
+	Name() string
+	Description() string
+	Eval(pluginsState *PluginsState, msg *dns.Msg) error
+}
+
+// PluginsGlobals holds the plugin chains built once at startup by
+// InitPluginsGlobals and shared, read-only, across all queries.
+type PluginsGlobals struct {
+	sync.RWMutex
+	queryPlugins    []Plugin
+	responsePlugins []Plugin
+	cache           *PluginCache
+}
+
+// PluginsState carries per-query state through the plugin pipeline.
+type PluginsState struct {
+	proxy         *Proxy
+	action        PluginsAction
+	clientProto   string
+	clientAddr    *net.Addr
+	synthResponse *dns.Msg
+	cacheKey      CacheKey
+	cacheKeySet   bool
+
+	// dnssecClientDO records whether the client's original query asked
+	// for DNSSEC records (the DO bit), before PluginDNSSECQuery forces it
+	// on for the outgoing query so upstream returns the RRSIGs needed to
+	// validate. nil means DNSSEC validation isn't enabled for this query.
+	// PluginDNSSECResponse uses it to decide whether to strip DNSSEC RRs
+	// and clear DO again before the response reaches the client, and
+	// cacheKeyFromMsg uses it so the cache key reflects what the client
+	// actually asked for rather than the forced value.
+	dnssecClientDO *bool
+
+	// serverCandidates is the server (or, under parallel-race, servers)
+	// the query will be forwarded to, selected before query plugins run
+	// so a plugin like PluginECSQuery can condition its behavior on the
+	// server(s) actually being used.
+	serverCandidates []*ServerInfo
+}
+
+func NewPluginsState(proxy *Proxy, clientProto string, clientAddr *net.Addr) PluginsState {
+	return PluginsState{
+		proxy:       proxy,
+		action:      PluginsActionForward,
+		clientProto: clientProto,
+		clientAddr:  clientAddr,
+	}
+}
+
+// InitPluginsGlobals builds the query and response plugin chains
+// according to the proxy's configuration. Plugins are ordered so that
+// cheaper, more decisive plugins (the cache) run before anything that
+// would otherwise go out to the network.
+func InitPluginsGlobals(pluginsGlobals *PluginsGlobals, proxy *Proxy) error {
+	queryPlugins := []Plugin{}
+	responsePlugins := []Plugin{}
+
+	if len(proxy.dnssecTrustAnchor) > 0 {
+		validator, err := NewDNSSECValidator(proxy.dnssecTrustAnchor)
+		if err != nil {
+			return err
+		}
+		proxy.dnssecValidator = validator
+		queryPlugins = append(queryPlugins, &PluginDNSSECQuery{})
+	}
+
+	queryPlugins = append(queryPlugins, &PluginECSQuery{})
+
+	var cache *PluginCache
+	if proxy.cache {
+		cache = NewPluginCache(proxy)
+		queryPlugins = append(queryPlugins, &PluginCacheQuery{cache: cache})
+	}
+
+	// DNSSEC must validate the raw upstream answer before anything else
+	// touches it, so that a bogus response is turned into SERVFAIL
+	// rather than being scrubbed, cached, or served.
+	if proxy.dnssecValidator != nil {
+		responsePlugins = append(responsePlugins, &PluginDNSSECResponse{})
+	}
+	responsePlugins = append(responsePlugins, &PluginECSResponse{})
+	if cache != nil {
+		responsePlugins = append(responsePlugins, &PluginCacheResponse{cache: cache})
+	}
+
+	pluginsGlobals.Lock()
+	pluginsGlobals.queryPlugins = queryPlugins
+	pluginsGlobals.responsePlugins = responsePlugins
+	pluginsGlobals.cache = cache
+	pluginsGlobals.Unlock()
+	return nil
+}
+
+// ApplyQueryPlugins unpacks query, runs it through every query plugin in
+// order until one sets an action other than PluginsActionForward, then
+// repacks (unless the query is being dropped or answered synthetically).
+func (pluginsState *PluginsState) ApplyQueryPlugins(pluginsGlobals *PluginsGlobals, query []byte) ([]byte, error) {
+	pluginsGlobals.RLock()
+	queryPlugins := pluginsGlobals.queryPlugins
+	pluginsGlobals.RUnlock()
+	if len(queryPlugins) == 0 {
+		return query, nil
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil {
+		return query, nil
+	}
+	for _, plugin := range queryPlugins {
+		if err := plugin.Eval(pluginsState, &msg); err != nil {
+			dlog.Warnf("Plugin [%s] failed: %v", plugin.Name(), err)
+			continue
+		}
+		if pluginsState.action != PluginsActionForward {
+			break
+		}
+	}
+	if pluginsState.action != PluginsActionForward {
+		return query, nil
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return query, nil
+	}
+	return packed, nil
+}
+
+// ApplyResponsePlugins unpacks response, runs it through the response
+// plugins in order, stopping early once one leaves it marked SERVFAIL,
+// then repacks.
+func (pluginsState *PluginsState) ApplyResponsePlugins(pluginsGlobals *PluginsGlobals, response []byte) ([]byte, error) {
+	pluginsGlobals.RLock()
+	responsePlugins := pluginsGlobals.responsePlugins
+	pluginsGlobals.RUnlock()
+	if len(responsePlugins) == 0 {
+		return response, nil
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err != nil {
+		return response, nil
+	}
+	for _, plugin := range responsePlugins {
+		if err := plugin.Eval(pluginsState, &msg); err != nil {
+			dlog.Warnf("Plugin [%s] failed: %v", plugin.Name(), err)
+			continue
+		}
+		// A plugin (e.g. DNSSEC validation) marking the response SERVFAIL
+		// is final: later plugins -- in particular the cache -- must not
+		// see it, or a single bogus/spurious failure would get negatively
+		// cached and served to every client for cacheNegTTL.
+		if msg.Rcode == dns.RcodeServerFailure {
+			break
+		}
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return response, nil
+	}
+	return packed, nil
+}
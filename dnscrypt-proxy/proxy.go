@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"io/ioutil"
+	"errors"
 	"math/rand"
 	"net"
 	"net/http"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -40,6 +40,17 @@ type Proxy struct {
 	cacheNegTTL                  uint32
 	cacheMinTTL                  uint32
 	cacheMaxTTL                  uint32
+	cachePrefetch                bool
+	cachePrefetchSeconds         uint32
+	cachePrefetchMinHits         uint64
+	ecsPolicy                    ECSPolicy
+	ecsFixedSubnet               *net.IPNet
+	dnssecTrustAnchor            string
+	dnssecValidatingServer       string
+	dnssecValidator              *DNSSECValidator
+	udpJobs                      chan udpJob
+	udpBufferPool                sync.Pool
+	udpWorkersOnce               sync.Once
 	queryLogFile                 string
 	queryLogFormat               string
 	queryLogIgnoredQtypes        []string
@@ -58,6 +69,8 @@ type Proxy struct {
 	maxClients                   uint32
 	httpTransport                *http.Transport
 	cachedIPs                    CachedIPs
+	lbStrategy                   LBStrategy
+	lbEstimatorBeta              float64
 }
 
 func (proxy *Proxy) StartProxy() {
@@ -66,6 +79,8 @@ func (proxy *Proxy) StartProxy() {
 		dlog.Fatal(err)
 	}
 	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
+	proxy.serversInfo.lbStrategy = proxy.lbStrategy
+	proxy.serversInfo.lbEstimatorBeta = proxy.lbEstimatorBeta
 	for _, registeredServer := range proxy.registeredServers {
 		proxy.serversInfo.registerServer(proxy, registeredServer.name, registeredServer.stamp)
 	}
@@ -157,33 +172,62 @@ func (proxy *Proxy) prefetcher(urlsToPrefetch *[]URLToPrefetch) {
 	}()
 }
 
+// udpListener reads packets off clientPc into pooled buffers and hands
+// them to the shared worker pool, rather than allocating a fresh buffer
+// and spawning a goroutine per query. A full worker queue drops the
+// query, preserving the previous drop-when-full behavior under load.
 func (proxy *Proxy) udpListener(clientPc *net.UDPConn) {
 	defer clientPc.Close()
 	for {
-		buffer := make([]byte, MaxDNSPacketSize-1)
+		bufPtr := proxy.udpBufferPool.Get().(*[]byte)
+		buffer := *bufPtr
 		length, clientAddr, err := clientPc.ReadFrom(buffer)
 		if err != nil {
+			proxy.udpBufferPool.Put(bufPtr)
 			return
 		}
-		packet := buffer[:length]
-		go func() {
-			if !proxy.clientsCountInc() {
-				dlog.Warnf("Too many connections (max=%d)", proxy.maxClients)
-				return
-			}
-			defer proxy.clientsCountDec()
-			proxy.processIncomingQuery(proxy.serversInfo.getOne(), "udp", proxy.mainProto, packet, &clientAddr, clientPc)
-		}()
+		if !proxy.clientsCountInc() {
+			dlog.Warnf("Too many connections (max=%d)", proxy.maxClients)
+			proxy.udpBufferPool.Put(bufPtr)
+			continue
+		}
+		job := udpJob{bufPtr: bufPtr, packet: buffer[:length], clientAddr: clientAddr, clientPc: clientPc}
+		select {
+		case proxy.udpJobs <- job:
+		default:
+			dlog.Debug("UDP worker queue is full, dropping query")
+			proxy.clientsCountDec()
+			proxy.udpBufferPool.Put(bufPtr)
+		}
 	}
 }
 
+// udpListenerFromAddr binds listenAddr, optionally as several
+// SO_REUSEPORT sockets on platforms that support it (Linux), so that
+// multiple listener goroutines can read from the kernel in parallel
+// instead of contending on a single UDP socket.
 func (proxy *Proxy) udpListenerFromAddr(listenAddr *net.UDPAddr) error {
-	clientPc, err := net.ListenUDP("udp", listenAddr)
-	if err != nil {
-		return err
+	proxy.startUDPWorkers()
+	numSockets := 1
+	if udpReusePortSupported {
+		numSockets = runtime.NumCPU()
+		if numSockets < 1 {
+			numSockets = 1
+		}
+	}
+	lc := reusePortListenConfig()
+	for i := 0; i < numSockets; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", listenAddr.String())
+		if err != nil {
+			return err
+		}
+		clientPc, ok := pc.(*net.UDPConn)
+		if !ok {
+			return errors.New("expected a UDP socket")
+		}
+		go proxy.udpListener(clientPc)
 	}
-	dlog.Noticef("Now listening to %v [UDP]", listenAddr)
-	go proxy.udpListener(clientPc)
+	dlog.Noticef("Now listening to %v [UDP] (%d socket(s))", listenAddr, numSockets)
 	return nil
 }
 
@@ -207,7 +251,7 @@ func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener) {
 				return
 			}
 			clientAddr := clientPc.RemoteAddr()
-			proxy.processIncomingQuery(proxy.serversInfo.getOne(), "tcp", "tcp", packet, &clientAddr, clientPc)
+			proxy.processIncomingQuery(context.Background(), "tcp", "tcp", packet, &clientAddr, clientPc)
 		}()
 	}
 }
@@ -222,41 +266,81 @@ func (proxy *Proxy) tcpListenerFromAddr(listenAddr *net.TCPAddr) error {
 	return nil
 }
 
-func (proxy *Proxy) exchangeWithUDPServer(serverInfo *ServerInfo, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
+func (proxy *Proxy) exchangeWithUDPServer(ctx context.Context, serverInfo *ServerInfo, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
 	pc, err := net.DialUDP("udp", nil, serverInfo.UDPAddr)
 	if err != nil {
 		return nil, err
 	}
+	defer pc.Close()
 	pc.SetDeadline(time.Now().Add(serverInfo.Timeout))
 	pc.Write(encryptedQuery)
+	type result struct {
+		length int
+		err    error
+	}
 	encryptedResponse := make([]byte, MaxDNSPacketSize)
-	length, err := pc.Read(encryptedResponse)
-	pc.Close()
-	if err != nil {
-		return nil, err
+	done := make(chan result, 1)
+	go func() {
+		length, err := pc.Read(encryptedResponse)
+		done <- result{length, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return proxy.Decrypt(serverInfo, encryptedResponse[:res.length], clientNonce)
 	}
-	encryptedResponse = encryptedResponse[:length]
-	return proxy.Decrypt(serverInfo, encryptedResponse, clientNonce)
 }
 
-func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
+func (proxy *Proxy) exchangeWithTCPServer(ctx context.Context, serverInfo *ServerInfo, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
 	pc, err := net.DialTCP("tcp", nil, serverInfo.TCPAddr)
 	if err != nil {
 		return nil, err
 	}
+	defer pc.Close()
 	pc.SetDeadline(time.Now().Add(serverInfo.Timeout))
 	encryptedQuery, err = PrefixWithSize(encryptedQuery)
 	if err != nil {
 		return nil, err
 	}
 	pc.Write(encryptedQuery)
+	type result struct {
+		response []byte
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		encryptedResponse, err := ReadPrefixed(pc)
+		done <- result{encryptedResponse, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return proxy.Decrypt(serverInfo, res.response, clientNonce)
+	}
+}
 
-	encryptedResponse, err := ReadPrefixed(pc)
-	pc.Close()
-	if err != nil {
-		return nil, err
+// exchangeWithServer dispatches query to serverInfo's Upstream. serverProto
+// ("udp" or "tcp") only affects DNSCrypt servers, which still need to pick
+// a transport for the encrypted wire format; every other upstream kind
+// picks its own transport internally. It is the unit of work raced in
+// parallel-race mode.
+func (proxy *Proxy) exchangeWithServer(ctx context.Context, serverInfo *ServerInfo, query []byte, serverProto string) ([]byte, error) {
+	if serverInfo.Upstream == nil {
+		dlog.Fatal("Server has no upstream configured")
+		return nil, errors.New("no upstream configured")
+	}
+	if upstream, ok := serverInfo.Upstream.(*dnsCryptUpstream); ok {
+		return upstream.exchange(ctx, query, serverProto)
 	}
-	return proxy.Decrypt(serverInfo, encryptedResponse, clientNonce)
+	return serverInfo.Upstream.Exchange(ctx, query)
 }
 
 func (proxy *Proxy) clientsCountInc() bool {
@@ -279,14 +363,27 @@ func (proxy *Proxy) clientsCountDec() {
 	}
 }
 
-func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto string, serverProto string, query []byte, clientAddr *net.Addr, clientPc net.Conn) {
-	if len(query) < MinDNSPacketSize || serverInfo == nil {
+func (proxy *Proxy) processIncomingQuery(ctx context.Context, clientProto string, serverProto string, query []byte, clientAddr *net.Addr, clientPc net.Conn) {
+	if len(query) < MinDNSPacketSize {
 		return
 	}
 	pluginsState := NewPluginsState(proxy, clientProto, clientAddr)
+
+	proxy.serversInfo.RLock()
+	strategy := proxy.serversInfo.lbStrategy
+	proxy.serversInfo.RUnlock()
+	var candidates []*ServerInfo
+	if strategy == LBStrategyParallelRace {
+		candidates = proxy.serversInfo.selectForRace()
+	} else if serverInfo := proxy.serversInfo.getOne(); serverInfo != nil {
+		candidates = []*ServerInfo{serverInfo}
+	}
+	pluginsState.serverCandidates = candidates
+
 	query, _ = pluginsState.ApplyQueryPlugins(&proxy.pluginsGlobals, query)
 	var response []byte
 	var err error
+	var serverInfo *ServerInfo
 	if pluginsState.action != PluginsActionForward {
 		if pluginsState.synthResponse != nil {
 			response, err = pluginsState.synthResponse.PackBuffer(response)
@@ -299,58 +396,30 @@ func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto str
 		}
 	}
 	if len(response) == 0 {
-		if serverInfo.Proto == StampProtoTypeDNSCrypt {
-			encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
-			if err != nil {
-				return
-			}
+		if len(candidates) == 0 {
+			return
+		}
+		if strategy == LBStrategyParallelRace {
+			serverInfo, response, err = raceQueries(ctx, proxy, candidates, query, serverProto, proxy.exchangeWithServer)
+		} else {
+			serverInfo = candidates[0]
 			serverInfo.noticeBegin(proxy)
-			if serverProto == "udp" {
-				response, err = proxy.exchangeWithUDPServer(serverInfo, encryptedQuery, clientNonce)
-			} else {
-				response, err = proxy.exchangeWithTCPServer(serverInfo, encryptedQuery, clientNonce)
-			}
+			response, err = proxy.exchangeWithServer(ctx, serverInfo, query, serverProto)
 			if err != nil {
 				serverInfo.noticeFailure(proxy)
-				return
-			}
-		} else if serverInfo.Proto == StampProtoTypeDoH {
-			req := &http.Request{
-				Method: "POST",
-				URL:    serverInfo.URL,
-				Host:   serverInfo.HostName,
-				Header: map[string][]string{
-					"Accept":       {"application/dns-udpwireformat"},
-					"Content-Type": {"application/dns-udpwireformat"},
-					"User-Agent":   {"dnscrypt-proxy"},
-				},
-				Close: false,
-				Body:  ioutil.NopCloser(bytes.NewReader(query)),
-			}
-			client := http.Client{
-				Transport: proxy.httpTransport,
-				Timeout:   proxy.timeout,
-			}
-			resp, err := client.Do(req)
-			if (err == nil && resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 299)) ||
-				err != nil || resp == nil {
-				return
-			}
-			response, err = ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return
+			} else {
+				serverInfo.noticeSuccess(proxy)
 			}
-		} else {
-			dlog.Fatal("Unsupported protocol")
 		}
-		if err != nil {
-			serverInfo.noticeFailure(proxy)
+		if err != nil || serverInfo == nil {
 			return
 		}
 		response, _ = pluginsState.ApplyResponsePlugins(&proxy.pluginsGlobals, response)
 	}
 	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
-		serverInfo.noticeFailure(proxy)
+		if serverInfo != nil {
+			serverInfo.noticeFailure(proxy)
+		}
 		return
 	}
 	if clientProto == "udp" {
@@ -369,10 +438,11 @@ func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto str
 	} else {
 		response, err = PrefixWithSize(response)
 		if err != nil {
-			serverInfo.noticeFailure(proxy)
+			if serverInfo != nil {
+				serverInfo.noticeFailure(proxy)
+			}
 			return
 		}
 		clientPc.Write(response)
 	}
-	serverInfo.noticeSuccess(proxy)
 }
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+type StampProtoType int
+
+const (
+	StampProtoTypeDNSCrypt StampProtoType = iota
+	StampProtoTypeDoH
+	StampProtoTypePlain
+	StampProtoTypeDoT
+)
+
+// LBStrategy selects which server(s) a query should be routed to.
+type LBStrategy int
+
+const (
+	LBStrategyFirst LBStrategy = iota
+	LBStrategyFastest
+	LBStrategyRandom
+	LBStrategyWeightedRandom
+	LBStrategyRoundRobin
+	LBStrategyParallelRace
+)
+
+// ParallelRaceCount is the number of servers dispatched to concurrently
+// when LBStrategyParallelRace is selected.
+const ParallelRaceCount = 3
+
+// consecutiveFailuresThreshold is the number of consecutive failures after
+// which a server is quarantined instead of being offered for selection.
+const consecutiveFailuresThreshold = 5
+
+// quarantineDuration is how long a quarantined server is skipped before
+// being probed again.
+const quarantineDuration = 1 * time.Minute
+
+func LBStrategyFromString(str string) LBStrategy {
+	switch str {
+	case "fastest":
+		return LBStrategyFastest
+	case "random":
+		return LBStrategyRandom
+	case "weighted-random", "weighted_random":
+		return LBStrategyWeightedRandom
+	case "round-robin", "round_robin":
+		return LBStrategyRoundRobin
+	case "parallel-race", "parallel_race", "p2":
+		return LBStrategyParallelRace
+	default:
+		return LBStrategyFirst
+	}
+}
+
+type ServerInfo struct {
+	Name     string
+	Proto    StampProtoType
+	UDPAddr  *net.UDPAddr
+	TCPAddr  *net.TCPAddr
+	URL      *url.URL
+	HostName string
+	Timeout  time.Duration
+
+	// Upstream is how queries are actually exchanged with this server.
+	// It replaces switching on Proto at the call site: DNSCrypt, plain
+	// DNS, DoT and DoH all implement the same interface.
+	Upstream Upstream
+
+	// ECSForward reports whether this server's stamp opts in to
+	// receiving the real client subnet under ecs_policy "forward".
+	ECSForward bool
+
+	sync.RWMutex
+	rtt                 float64 // EWMA round-trip time, in milliseconds
+	successCount        uint64
+	failureCount        uint64
+	consecutiveFailures uint32
+	quarantinedUntil    time.Time
+	lastActionTS        time.Time
+}
+
+func (serverInfo *ServerInfo) noticeBegin(proxy *Proxy) {
+	serverInfo.Lock()
+	serverInfo.lastActionTS = time.Now()
+	serverInfo.Unlock()
+}
+
+func (serverInfo *ServerInfo) noticeSuccess(proxy *Proxy) {
+	elapsed := time.Since(serverInfo.lastActionTS)
+	serverInfo.Lock()
+	serverInfo.successCount++
+	serverInfo.consecutiveFailures = 0
+	serverInfo.updateRTT(proxy.lbEstimatorBeta, float64(elapsed.Milliseconds()))
+	serverInfo.Unlock()
+}
+
+func (serverInfo *ServerInfo) noticeFailure(proxy *Proxy) {
+	serverInfo.Lock()
+	serverInfo.failureCount++
+	serverInfo.consecutiveFailures++
+	if serverInfo.consecutiveFailures >= consecutiveFailuresThreshold {
+		serverInfo.quarantinedUntil = time.Now().Add(quarantineDuration)
+		dlog.Infof("[%s] quarantined for %v after %d consecutive failures", serverInfo.Name, quarantineDuration, serverInfo.consecutiveFailures)
+	}
+	serverInfo.Unlock()
+}
+
+// updateRTT folds a new RTT sample into the exponentially weighted moving
+// average using beta as the decay factor for past samples.
+func (serverInfo *ServerInfo) updateRTT(beta float64, sampleMs float64) {
+	if beta <= 0 || beta >= 1 {
+		beta = 0.7
+	}
+	if serverInfo.rtt == 0 {
+		serverInfo.rtt = sampleMs
+		return
+	}
+	serverInfo.rtt = beta*serverInfo.rtt + (1-beta)*sampleMs
+}
+
+func (serverInfo *ServerInfo) isQuarantined() bool {
+	serverInfo.RLock()
+	defer serverInfo.RUnlock()
+	return time.Now().Before(serverInfo.quarantinedUntil)
+}
+
+func (serverInfo *ServerInfo) currentRTT() float64 {
+	serverInfo.RLock()
+	defer serverInfo.RUnlock()
+	return serverInfo.rtt
+}
+
+type ServersInfo struct {
+	sync.RWMutex
+	inner             []*ServerInfo
+	registeredServers []RegisteredServer
+	roundRobinIdx     uint32
+	lbStrategy        LBStrategy
+	lbEstimatorBeta   float64
+}
+
+type RegisteredServer struct {
+	name  string
+	stamp ServerStamp
+}
+
+func (serversInfo *ServersInfo) registerServer(proxy *Proxy, name string, stamp ServerStamp) {
+	newServer := RegisteredServer{name: name, stamp: stamp}
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	for i, oldServer := range serversInfo.registeredServers {
+		if oldServer.name == name {
+			serversInfo.registeredServers[i] = newServer
+			return
+		}
+	}
+	serversInfo.registeredServers = append(serversInfo.registeredServers, newServer)
+}
+
+// byName returns the server registered under name, or nil. It is used to
+// pin a specific step of a multi-query operation (e.g. DNSSEC chasing)
+// to a single designated server rather than whatever the load-balancing
+// strategy would otherwise pick.
+func (serversInfo *ServersInfo) byName(name string) *ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	for _, serverInfo := range serversInfo.inner {
+		if serverInfo.Name == name {
+			return serverInfo
+		}
+	}
+	return nil
+}
+
+// liveServers returns the number of servers that are not currently
+// quarantined by the circuit breaker.
+func (serversInfo *ServersInfo) liveServers() int {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	live := 0
+	for _, serverInfo := range serversInfo.inner {
+		if !serverInfo.isQuarantined() {
+			live++
+		}
+	}
+	return live
+}
+
+// buildServerInfo resolves a registered server's stamp into a *ServerInfo
+// ready to be added to ServersInfo.inner: its UDP/TCP address or URL, and
+// (for DoH servers that carry no ServerAddrStr) its TCP address left
+// unresolved for NewUpstream to dial by name.
+func buildServerInfo(proxy *Proxy, name string, stamp ServerStamp) (*ServerInfo, error) {
+	serverInfo := &ServerInfo{
+		Name:       name,
+		Proto:      stamp.Proto,
+		HostName:   stamp.ProviderName,
+		Timeout:    proxy.timeout,
+		ECSForward: ServerInformalProperties(stamp.Props)&ServerInformalPropertyECS != 0,
+	}
+	if stamp.Proto == StampProtoTypeDoH {
+		serverInfo.URL = &url.URL{Scheme: "https", Host: stamp.ProviderName, Path: stamp.Path}
+		if len(stamp.ServerAddrStr) > 0 {
+			if tcpAddr, err := net.ResolveTCPAddr("tcp", stamp.ServerAddrStr); err == nil {
+				serverInfo.TCPAddr = tcpAddr
+			}
+		}
+	} else {
+		if len(stamp.ServerAddrStr) == 0 {
+			return nil, errors.New("stamp for [" + name + "] carries no server address")
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp", stamp.ServerAddrStr)
+		if err != nil {
+			return nil, err
+		}
+		tcpAddr, err := net.ResolveTCPAddr("tcp", stamp.ServerAddrStr)
+		if err != nil {
+			return nil, err
+		}
+		serverInfo.UDPAddr = udpAddr
+		serverInfo.TCPAddr = tcpAddr
+	}
+	upstream, err := NewUpstream(proxy, serverInfo, stamp)
+	if err != nil {
+		return nil, err
+	}
+	serverInfo.Upstream = upstream
+	return serverInfo, nil
+}
+
+// refresh rebuilds inner from the registered servers. Servers that are
+// already in inner are carried over as-is, so a periodic refresh doesn't
+// reset their RTT/failure history; new ones are built from their stamps.
+// It sends no query to any server: a quarantined server is not probed
+// here, and is offered for selection again once its quarantine period
+// has elapsed.
+func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
+	serversInfo.RLock()
+	registeredServers := serversInfo.registeredServers
+	existing := serversInfo.inner
+	serversInfo.RUnlock()
+
+	existingByName := make(map[string]*ServerInfo, len(existing))
+	for _, serverInfo := range existing {
+		existingByName[serverInfo.Name] = serverInfo
+	}
+
+	inner := make([]*ServerInfo, 0, len(registeredServers))
+	var lastErr error
+	for _, registeredServer := range registeredServers {
+		dlog.Debugf("Refreshing [%s]", registeredServer.name)
+		if serverInfo, ok := existingByName[registeredServer.name]; ok {
+			inner = append(inner, serverInfo)
+			continue
+		}
+		serverInfo, err := buildServerInfo(proxy, registeredServer.name, registeredServer.stamp)
+		if err != nil {
+			dlog.Warnf("Unable to register [%s]: %v", registeredServer.name, err)
+			lastErr = err
+			continue
+		}
+		inner = append(inner, serverInfo)
+	}
+
+	serversInfo.Lock()
+	serversInfo.inner = inner
+	serversInfo.Unlock()
+	return serversInfo.liveServers(), lastErr
+}
+
+// availableServers returns the subset of inner servers eligible for
+// selection, i.e. not currently quarantined. If quarantining has taken
+// every server offline, all of them are returned so the proxy degrades
+// instead of refusing to answer entirely.
+func (serversInfo *ServersInfo) availableServers() []*ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	available := make([]*ServerInfo, 0, len(serversInfo.inner))
+	for _, serverInfo := range serversInfo.inner {
+		if !serverInfo.isQuarantined() {
+			available = append(available, serverInfo)
+		}
+	}
+	if len(available) == 0 {
+		available = append(available, serversInfo.inner...)
+	}
+	return available
+}
+
+// getOne returns a single server, selected according to the configured
+// load-balancing strategy. It preserves the historical "first available
+// server" behavior when no strategy has been configured.
+func (serversInfo *ServersInfo) getOne() *ServerInfo {
+	candidates := serversInfo.availableServers()
+	if len(candidates) == 0 {
+		return nil
+	}
+	serversInfo.RLock()
+	strategy := serversInfo.lbStrategy
+	serversInfo.RUnlock()
+	switch strategy {
+	case LBStrategyFastest:
+		return fastestServer(candidates)
+	case LBStrategyRandom:
+		return candidates[rand.Intn(len(candidates))]
+	case LBStrategyWeightedRandom:
+		return weightedRandomServer(candidates)
+	case LBStrategyRoundRobin:
+		idx := serversInfo.nextRoundRobinIdx()
+		return candidates[idx%uint32(len(candidates))]
+	case LBStrategyParallelRace:
+		// getOne is used by callers that only want a single server (e.g.
+		// cache prefetch, DNSSEC chain chasing); parallel-race dispatch
+		// itself happens in selectForRace.
+		return fastestServer(candidates)
+	default:
+		return candidates[0]
+	}
+}
+
+// selectForRace returns up to ParallelRaceCount candidates, ordered by
+// ascending RTT, for a parallel-race dispatch.
+func (serversInfo *ServersInfo) selectForRace() []*ServerInfo {
+	candidates := serversInfo.availableServers()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].currentRTT() < candidates[j].currentRTT()
+	})
+	if len(candidates) > ParallelRaceCount {
+		candidates = candidates[:ParallelRaceCount]
+	}
+	return candidates
+}
+
+func (serversInfo *ServersInfo) nextRoundRobinIdx() uint32 {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	idx := serversInfo.roundRobinIdx
+	serversInfo.roundRobinIdx++
+	return idx
+}
+
+func fastestServer(candidates []*ServerInfo) *ServerInfo {
+	best := candidates[0]
+	bestRTT := best.currentRTT()
+	// An RTT of 0 (no sample yet) ranks lowest, so unmeasured servers are
+	// picked first and get a chance to be measured.
+	for _, candidate := range candidates[1:] {
+		if rtt := candidate.currentRTT(); rtt < bestRTT {
+			best = candidate
+			bestRTT = rtt
+		}
+	}
+	return best
+}
+
+// weightedRandomServer picks a candidate with probability inversely
+// proportional to its recent RTT: consistently fast servers are favored
+// without starving the rest of their share of traffic.
+func weightedRandomServer(candidates []*ServerInfo) *ServerInfo {
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, candidate := range candidates {
+		rtt := candidate.currentRTT()
+		if rtt <= 0 {
+			rtt = 1
+		}
+		weights[i] = 1 / rtt
+		total += weights[i]
+	}
+	if total <= 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+	pick := rand.Float64() * total
+	for i, weight := range weights {
+		pick -= weight
+		if pick <= 0 {
+			return candidates[i]
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// raceResult carries the outcome of one leg of a parallel-race dispatch.
+type raceResult struct {
+	serverInfo *ServerInfo
+	response   []byte
+	err        error
+}
+
+// raceQueries dispatches query concurrently to every server in candidates,
+// returning the first successful response and canceling the rest. ctx is
+// threaded through the exchange functions so the losing requests are
+// actually aborted rather than left to run to completion.
+func raceQueries(ctx context.Context, proxy *Proxy, candidates []*ServerInfo, query []byte, serverProto string, exchange func(ctx context.Context, serverInfo *ServerInfo, query []byte, serverProto string) ([]byte, error)) (*ServerInfo, []byte, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult, len(candidates))
+	for _, candidate := range candidates {
+		go func(serverInfo *ServerInfo) {
+			serverInfo.noticeBegin(proxy)
+			response, err := exchange(raceCtx, serverInfo, query, serverProto)
+			results <- raceResult{serverInfo: serverInfo, response: response, err: err}
+		}(candidate)
+	}
+	var lastErr error
+	for i := 0; i < len(candidates); i++ {
+		result := <-results
+		if result.err != nil {
+			if result.err != context.Canceled {
+				result.serverInfo.noticeFailure(proxy)
+				lastErr = result.err
+			}
+			continue
+		}
+		result.serverInfo.noticeSuccess(proxy)
+		cancel()
+		return result.serverInfo, result.response, nil
+	}
+	return nil, nil, lastErr
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func serverWithRTT(name string, rtt float64) *ServerInfo {
+	return &ServerInfo{Name: name, rtt: rtt}
+}
+
+func TestFastestServerPicksLowestNonZeroRTT(t *testing.T) {
+	candidates := []*ServerInfo{
+		serverWithRTT("slow", 80),
+		serverWithRTT("fast", 20),
+		serverWithRTT("medium", 40),
+	}
+	if got := fastestServer(candidates); got.Name != "fast" {
+		t.Fatalf("expected fast, got %s", got.Name)
+	}
+}
+
+func TestFastestServerPrefersUnmeasuredOverSlower(t *testing.T) {
+	// An RTT of 0 means no sample yet, not "instant" - it should still be
+	// preferred over a server with a measured RTT so new/recovered
+	// servers get a chance to be probed.
+	candidates := []*ServerInfo{
+		serverWithRTT("measured", 10),
+		serverWithRTT("unmeasured", 0),
+	}
+	if got := fastestServer(candidates); got.Name != "unmeasured" {
+		t.Fatalf("expected unmeasured, got %s", got.Name)
+	}
+}
+
+func TestWeightedRandomServerSkipsZeroWeightDivision(t *testing.T) {
+	// All-zero RTTs must not panic or pick nothing.
+	candidates := []*ServerInfo{serverWithRTT("a", 0), serverWithRTT("b", 0)}
+	got := weightedRandomServer(candidates)
+	if got == nil {
+		t.Fatal("expected a server, got nil")
+	}
+}
+
+func TestWeightedRandomServerPicksEveryCandidate(t *testing.T) {
+	candidates := []*ServerInfo{serverWithRTT("a", 5), serverWithRTT("b", 10), serverWithRTT("c", 20)}
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		seen[weightedRandomServer(candidates).Name] = true
+	}
+	for _, candidate := range candidates {
+		if !seen[candidate.Name] {
+			t.Fatalf("%s was never picked across 200 draws", candidate.Name)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+// ServerInformalProperties are informal, advisory properties a server's
+// stamp advertises about itself, packed as bit flags into
+// ServerStamp.Props.
+type ServerInformalProperties uint64
+
+const (
+	// ServerInformalPropertyECS marks a server as willing to receive the
+	// real (truncated) client subnet via EDNS Client Subnet when the
+	// proxy's ecs_policy is "forward". Servers that don't advertise it
+	// only ever see a client subnet under ecs_policy "inject".
+	ServerInformalPropertyECS ServerInformalProperties = 1 << iota
+)
+
+// ServerStamp holds the information extracted from a server's sdns://
+// stamp: how to reach it and how to authenticate it.
+type ServerStamp struct {
+	ServerAddrStr string
+	ProviderName  string
+	ServerPk      [32]byte
+	Props         uint64
+	Path          string
+	Proto         StampProtoType
+
+	// Hashes holds the SHA-256 digests of the SubjectPublicKeyInfo of the
+	// certificates dnscrypt-proxy is allowed to pin to, for protocols
+	// that authenticate the upstream via TLS rather than the DNSCrypt key
+	// exchange. DoT upstreams check the server's certificates against
+	// them; DoH upstreams keep them but do not check them.
+	Hashes [][]byte
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// udpJob is one inbound query handed from a listener goroutine to the
+// shared worker pool. bufPtr is returned to the buffer pool once the
+// worker is done with packet, which aliases it.
+type udpJob struct {
+	bufPtr     *[]byte
+	packet     []byte
+	clientAddr net.Addr
+	clientPc   *net.UDPConn
+}
+
+// startUDPWorkers lazily initializes the buffer pool and spawns the
+// fixed-size worker pool that processes every UDP query, regardless of
+// how many listen addresses or SO_REUSEPORT sockets feed it. It is
+// idempotent so each udpListenerFromAddr call can call it unconditionally.
+func (proxy *Proxy) startUDPWorkers() {
+	proxy.udpWorkersOnce.Do(func() {
+		proxy.udpBufferPool = sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, MaxDNSPacketSize-1)
+				return &buf
+			},
+		}
+		workerCount := int(proxy.maxClients)
+		if workerCount <= 0 {
+			workerCount = 1
+		}
+		proxy.udpJobs = make(chan udpJob, workerCount*4)
+		for i := 0; i < workerCount; i++ {
+			go proxy.udpWorker()
+		}
+	})
+}
+
+func (proxy *Proxy) udpWorker() {
+	for job := range proxy.udpJobs {
+		clientAddr := job.clientAddr
+		proxy.processIncomingQuery(context.Background(), "udp", proxy.mainProto, job.packet, &clientAddr, job.clientPc)
+		proxy.clientsCountDec()
+		proxy.udpBufferPool.Put(job.bufPtr)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// These benchmarks isolate the two patterns udpListener moved away from in
+// favor of pooled buffers and a bounded worker pool, so a regression in
+// either shows up here rather than only in production QPS.
+
+// handOffToConsumer sends buf to a consumer goroutine and waits for it to
+// read the first byte back, forcing the buffer to actually escape to the
+// heap rather than let escape analysis prove it never leaves the loop
+// iteration, which would make both benchmarks below report 0 allocs/op and
+// defeat the comparison they exist to make.
+func handOffToConsumer(bufs chan<- []byte, done <-chan byte, buf []byte) byte {
+	bufs <- buf
+	return <-done
+}
+
+// BenchmarkUDPBufferAllocPerPacket allocates a fresh receive buffer per
+// packet, as udpListener did before buffers were pooled.
+func BenchmarkUDPBufferAllocPerPacket(b *testing.B) {
+	bufs := make(chan []byte)
+	done := make(chan byte)
+	go func() {
+		for buf := range bufs {
+			done <- buf[0]
+		}
+	}()
+	defer close(bufs)
+
+	var sink byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := make([]byte, MaxDNSPacketSize-1)
+		sink = handOffToConsumer(bufs, done, buf)
+	}
+	sinkByte = sink
+}
+
+// BenchmarkUDPBufferPool exercises the sync.Pool-backed buffer reuse that
+// udpListener uses now.
+func BenchmarkUDPBufferPool(b *testing.B) {
+	pool := sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, MaxDNSPacketSize-1)
+			return &buf
+		},
+	}
+	bufs := make(chan []byte)
+	done := make(chan byte)
+	go func() {
+		for buf := range bufs {
+			done <- buf[0]
+		}
+	}()
+	defer close(bufs)
+
+	var sink byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bufPtr := pool.Get().(*[]byte)
+		sink = handOffToConsumer(bufs, done, *bufPtr)
+		pool.Put(bufPtr)
+	}
+	sinkByte = sink
+}
+
+// sinkByte defeats dead-store elimination of the benchmarks' final read,
+// without which the compiler could prove the consumer's result is unused
+// and eliminate the handoff entirely.
+var sinkByte byte
+
+// BenchmarkGoroutinePerQuery spawns and joins a goroutine per query, as
+// udpListener did before queries were dispatched to a bounded worker pool.
+func BenchmarkGoroutinePerQuery(b *testing.B) {
+	var wg sync.WaitGroup
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkWorkerPoolDispatch hands a job to a fixed-size pool of
+// long-lived workers over a channel, as udpWorker does now.
+func BenchmarkWorkerPoolDispatch(b *testing.B) {
+	const workers = 8
+	jobs := make(chan struct{}, workers*4)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for range jobs {
+			}
+		}()
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+// udpReusePortSupported is false on platforms without SO_REUSEPORT
+// multi-socket support; udpListenerFromAddr binds a single socket.
+const udpReusePortSupported = false
+
+func reusePortListenConfig() net.ListenConfig {
+	return net.ListenConfig{}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// Upstream abstracts away the wire protocol used to reach a server, so
+// that the proxy's query path does not need to know whether it is
+// talking DNSCrypt, plain DNS, DoT or DoH.
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	Protocol() StampProtoType
+	Address() string
+}
+
+// NewUpstream builds the Upstream implementation matching a server's
+// stamp, wiring it to the proxy's DNSCrypt key exchange or to plain/TLS
+// transports as appropriate.
+func NewUpstream(proxy *Proxy, serverInfo *ServerInfo, stamp ServerStamp) (Upstream, error) {
+	switch stamp.Proto {
+	case StampProtoTypeDNSCrypt:
+		return &dnsCryptUpstream{proxy: proxy, serverInfo: serverInfo}, nil
+	case StampProtoTypePlain:
+		return newPlainUpstream(stamp.ServerAddrStr, serverInfo.Timeout)
+	case StampProtoTypeDoT:
+		return newDoTUpstream(stamp.ServerAddrStr, stamp.ProviderName, stamp.Hashes, serverInfo.Timeout)
+	case StampProtoTypeDoH:
+		return newDoHUpstream(proxy, serverInfo.URL, serverInfo.HostName, stamp.Hashes)
+	default:
+		return nil, errors.New("unsupported stamp protocol")
+	}
+}
+
+// dnsCryptUpstream delegates to the existing DNSCrypt encrypt/exchange
+// machinery, preserving the historical behavior for encrypted servers.
+type dnsCryptUpstream struct {
+	proxy      *Proxy
+	serverInfo *ServerInfo
+}
+
+// Exchange satisfies the Upstream interface for callers that don't care
+// which transport is used; it always picks "udp". Callers that need to
+// pick the transport per query (exchangeWithServer, which is handed the
+// query path's serverProto) should call exchange directly instead, since proto can't safely be
+// threaded through a shared *dnsCryptUpstream as mutable state.
+func (u *dnsCryptUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return u.exchange(ctx, query, "udp")
+}
+
+func (u *dnsCryptUpstream) exchange(ctx context.Context, query []byte, proto string) ([]byte, error) {
+	if proto == "" {
+		proto = "udp"
+	}
+	encryptedQuery, clientNonce, err := u.proxy.Encrypt(u.serverInfo, query, proto)
+	if err != nil {
+		return nil, err
+	}
+	if proto == "udp" {
+		return u.proxy.exchangeWithUDPServer(ctx, u.serverInfo, encryptedQuery, clientNonce)
+	}
+	return u.proxy.exchangeWithTCPServer(ctx, u.serverInfo, encryptedQuery, clientNonce)
+}
+
+func (u *dnsCryptUpstream) Protocol() StampProtoType { return StampProtoTypeDNSCrypt }
+func (u *dnsCryptUpstream) Address() string          { return u.serverInfo.UDPAddr.String() }
+
+// plainUpstream speaks unencrypted DNS over UDP, falling back to TCP when
+// the response is truncated. It exists so that a local resolver or a
+// bootstrap server can be used without a DNSCrypt or TLS handshake.
+type plainUpstream struct {
+	addr    string
+	udpAddr *net.UDPAddr
+	tcpAddr *net.TCPAddr
+	timeout time.Duration
+}
+
+func newPlainUpstream(addrStr string, timeout time.Duration) (*plainUpstream, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addrStr)
+	if err != nil {
+		return nil, err
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addrStr)
+	if err != nil {
+		return nil, err
+	}
+	return &plainUpstream{addr: addrStr, udpAddr: udpAddr, tcpAddr: tcpAddr, timeout: timeout}, nil
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	response, truncated, err := u.exchangeUDP(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if !truncated {
+		return response, nil
+	}
+	return u.exchangeTCP(ctx, query)
+}
+
+func (u *plainUpstream) exchangeUDP(ctx context.Context, query []byte) ([]byte, bool, error) {
+	pc, err := net.DialUDP("udp", nil, u.udpAddr)
+	if err != nil {
+		return nil, false, err
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(u.timeout))
+	if _, err := pc.Write(query); err != nil {
+		return nil, false, err
+	}
+	type result struct {
+		length int
+		err    error
+	}
+	buf := make([]byte, MaxDNSPacketSize)
+	done := make(chan result, 1)
+	go func() {
+		length, err := pc.Read(buf)
+		done <- result{length, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return nil, false, res.err
+		}
+		response := buf[:res.length]
+		return response, HasTCFlag(response), nil
+	}
+}
+
+func (u *plainUpstream) exchangeTCP(ctx context.Context, query []byte) ([]byte, error) {
+	pc, err := net.DialTCP("tcp", nil, u.tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(u.timeout))
+	prefixed, err := PrefixWithSize(query)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pc.Write(prefixed); err != nil {
+		return nil, err
+	}
+	type result struct {
+		response []byte
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		response, err := ReadPrefixed(pc)
+		done <- result{response, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-done:
+		return res.response, res.err
+	}
+}
+
+func (u *plainUpstream) Protocol() StampProtoType { return StampProtoTypePlain }
+func (u *plainUpstream) Address() string          { return u.addr }
+
+// dotUpstream speaks DNS-over-TLS (RFC 7858) over TCP/853, authenticating
+// the server by pinning the SHA-256 of its certificate's
+// SubjectPublicKeyInfo against the hashes carried in its stamp.
+type dotUpstream struct {
+	addr       string
+	serverName string
+	pins       [][]byte
+	timeout    time.Duration
+}
+
+func newDoTUpstream(addrStr string, serverName string, pins [][]byte, timeout time.Duration) (*dotUpstream, error) {
+	if _, _, err := net.SplitHostPort(addrStr); err != nil {
+		addrStr = net.JoinHostPort(addrStr, "853")
+	}
+	return &dotUpstream{addr: addrStr, serverName: serverName, pins: pins, timeout: timeout}, nil
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: u.timeout}
+	rawConn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(rawConn, &tls.Config{
+		ServerName:         u.serverName,
+		InsecureSkipVerify: len(u.pins) > 0,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifySPKIPins(rawCerts, u.pins)
+		},
+	})
+	defer tlsConn.Close()
+	tlsConn.SetDeadline(time.Now().Add(u.timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	prefixed, err := PrefixWithSize(query)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tlsConn.Write(prefixed); err != nil {
+		return nil, err
+	}
+	type result struct {
+		response []byte
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		response, err := ReadPrefixed(tlsConn)
+		done <- result{response, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-done:
+		return res.response, res.err
+	}
+}
+
+func (u *dotUpstream) Protocol() StampProtoType { return StampProtoTypeDoT }
+func (u *dotUpstream) Address() string          { return u.addr }
+
+// verifySPKIPins checks that at least one certificate offered by the
+// server has a SubjectPublicKeyInfo whose SHA-256 digest matches one of
+// the pinned hashes. If no pins are configured, verification is left to
+// the standard TLS chain validation.
+func verifySPKIPins(rawCerts [][]byte, pins [][]byte) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			continue
+		}
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(digest[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("certificate does not match any pinned SPKI hash")
+}
+
+// dohUpstream speaks DNS-over-HTTPS using the RFC 8484 "application/dns-message"
+// media type, using GET with a base64url-encoded query when the server
+// supports it (cache-friendly) and falling back to POST otherwise.
+type dohUpstream struct {
+	proxy    *Proxy
+	url      *url.URL
+	hostName string
+	useGet   bool
+	hashes   [][]byte
+}
+
+func newDoHUpstream(proxy *Proxy, serverURL *url.URL, hostName string, hashes [][]byte) (*dohUpstream, error) {
+	if serverURL == nil {
+		return nil, errors.New("DoH upstream requires a URL")
+	}
+	return &dohUpstream{proxy: proxy, url: serverURL, hostName: hostName, useGet: true, hashes: hashes}, nil
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if u.useGet {
+		response, err := u.exchangeGet(ctx, query)
+		if err == nil {
+			return response, nil
+		}
+		dlog.Debugf("DoH GET failed against [%s], falling back to POST: %v", u.url, err)
+	}
+	return u.exchangePost(ctx, query)
+}
+
+func (u *dohUpstream) exchangeGet(ctx context.Context, query []byte) ([]byte, error) {
+	getURL := *u.url
+	encoded := base64.RawURLEncoding.EncodeToString(query)
+	q := getURL.Query()
+	q.Set("dns", encoded)
+	getURL.RawQuery = q.Encode()
+	req := &http.Request{
+		Method: "GET",
+		URL:    &getURL,
+		Host:   u.hostName,
+		Header: map[string][]string{
+			"Accept":     {"application/dns-message"},
+			"User-Agent": {"dnscrypt-proxy"},
+		},
+	}
+	return u.do(ctx, req)
+}
+
+func (u *dohUpstream) exchangePost(ctx context.Context, query []byte) ([]byte, error) {
+	req := &http.Request{
+		Method: "POST",
+		URL:    u.url,
+		Host:   u.hostName,
+		Header: map[string][]string{
+			"Accept":       {"application/dns-message"},
+			"Content-Type": {"application/dns-message"},
+			"User-Agent":   {"dnscrypt-proxy"},
+		},
+		Close: false,
+		Body:  ioutil.NopCloser(bytes.NewReader(query)),
+	}
+	return u.do(ctx, req)
+}
+
+func (u *dohUpstream) do(ctx context.Context, req *http.Request) ([]byte, error) {
+	req = req.WithContext(ctx)
+	client := http.Client{
+		Transport: u.proxy.httpTransport,
+		Timeout:   u.proxy.timeout,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New("DoH request failed with status " + resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (u *dohUpstream) Protocol() StampProtoType { return StampProtoTypeDoH }
+func (u *dohUpstream) Address() string          { return u.url.String() }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func generateTestCert(t *testing.T) []byte {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	return der
+}
+
+func spkiPin(t *testing.T, der []byte) []byte {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return digest[:]
+}
+
+func TestVerifySPKIPinsNoPinsConfigured(t *testing.T) {
+	der := generateTestCert(t)
+	if err := verifySPKIPins([][]byte{der}, nil); err != nil {
+		t.Fatalf("expected no error with no pins configured, got %v", err)
+	}
+}
+
+func TestVerifySPKIPinsMatch(t *testing.T) {
+	der := generateTestCert(t)
+	pin := spkiPin(t, der)
+	if err := verifySPKIPins([][]byte{der}, [][]byte{pin}); err != nil {
+		t.Fatalf("expected matching pin to verify, got %v", err)
+	}
+}
+
+func TestVerifySPKIPinsMismatch(t *testing.T) {
+	der := generateTestCert(t)
+	wrongPin := make([]byte, sha256.Size)
+	if err := verifySPKIPins([][]byte{der}, [][]byte{wrongPin}); err == nil {
+		t.Fatal("expected an error for a non-matching pin, got nil")
+	}
+}
+
+func TestVerifySPKIPinsMatchesAnyConfiguredPin(t *testing.T) {
+	der := generateTestCert(t)
+	pin := spkiPin(t, der)
+	wrongPin := make([]byte, sha256.Size)
+	if err := verifySPKIPins([][]byte{der}, [][]byte{wrongPin, pin}); err != nil {
+		t.Fatalf("expected the cert to match the second configured pin, got %v", err)
+	}
+}